@@ -0,0 +1,275 @@
+package gosto
+
+import (
+	"bytes"
+	"context"
+	"encoding/ascii85"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"cloud.google.com/go/datastore"
+)
+
+var (
+	// MemcachePutTimeoutSmall is the cache write deadline used for payloads
+	// at or below MemcachePutTimeoutThreshold bytes.
+	MemcachePutTimeoutSmall = 500 * time.Millisecond
+	// MemcachePutTimeoutLarge is the cache write deadline used for payloads
+	// above MemcachePutTimeoutThreshold bytes.
+	MemcachePutTimeoutLarge = 5 * time.Second
+	// MemcachePutTimeoutThreshold is the payload size, in bytes, above which
+	// MemcachePutTimeoutLarge is used instead of MemcachePutTimeoutSmall.
+	MemcachePutTimeoutThreshold = 64 * 1024
+)
+
+// cacheNoSuchEntity is stored in place of a real payload to remember that a
+// key doesn't exist, so repeated Gets for it don't fall through to
+// Datastore.
+var cacheNoSuchEntity = []byte{0}
+
+// Cache is a pluggable second-tier cache sitting in front of Datastore,
+// analogous to goon's memcache layer. Keys are the fingerprint returned by
+// cacheKey, and values are gob-encoded, version-tagged payloads produced by
+// encodeCacheEntry.
+type Cache interface {
+	GetMulti(ctx context.Context, keys []string) (map[string][]byte, error)
+	SetMulti(ctx context.Context, items map[string][]byte, timeout time.Duration) error
+	DeleteMulti(ctx context.Context, keys []string) error
+}
+
+// putTimeout returns the cache write deadline for a payload of size n
+// bytes, growing once n crosses MemcachePutTimeoutThreshold.
+func putTimeout(n int) time.Duration {
+	if n > MemcachePutTimeoutThreshold {
+		return MemcachePutTimeoutLarge
+	}
+	return MemcachePutTimeoutSmall
+}
+
+// cacheKey returns the BLAKE2b/ascii85 fingerprint gosto uses as the cache
+// key for k.
+func cacheKey(k *datastore.Key) string {
+	sum := blake2b.Sum256([]byte(k.Encode()))
+	enc := make([]byte, ascii85.MaxEncodedLen(len(sum)))
+	n := ascii85.Encode(enc, sum[:])
+	return string(enc[:n])
+}
+
+// cacheVersion is a short BLAKE2b-derived tag identifying the Go type an
+// entry was encoded from, so schema drift causes a cache miss rather than
+// a gob decode error.
+func cacheVersion(v interface{}) [4]byte {
+	sum := blake2b.Sum256([]byte(fmt.Sprintf("%T", v)))
+	var tag [4]byte
+	copy(tag[:], sum[:])
+	return tag
+}
+
+// encodeCacheEntry gob-encodes src prefixed with its cacheVersion tag.
+func encodeCacheEntry(src interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	tag := cacheVersion(src)
+	buf.Write(tag[:])
+	if err := gob.NewEncoder(&buf).Encode(src); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeCacheEntry decodes data into dst. ok is false, with a nil error,
+// when data's version tag doesn't match dst's current type - that's a
+// schema-drift miss, not a decode failure, and callers should treat it as
+// if the cache didn't have the entry at all.
+func decodeCacheEntry(data []byte, dst interface{}) (ok bool, err error) {
+	tag := cacheVersion(dst)
+	if len(data) < len(tag) || !bytes.Equal(data[:len(tag)], tag[:]) {
+		return false, nil
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data[len(tag):])).Decode(dst); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// cacheEntryPtr returns a pointer suitable for gob-encoding/decoding the
+// entity held by elem, which may be a struct, a struct pointer, or (as
+// happens when Get calls through to GetMulti) an interface wrapping either.
+func cacheEntryPtr(elem reflect.Value) interface{} {
+	for elem.Kind() == reflect.Interface {
+		elem = elem.Elem()
+	}
+	if elem.Kind() == reflect.Ptr {
+		if elem.IsNil() && elem.CanSet() {
+			elem.Set(reflect.New(elem.Type().Elem()))
+		}
+		return elem.Interface()
+	}
+	return elem.Addr().Interface()
+}
+
+// localGet reads from the per-request, process-local cache tier.
+func (g *Gosto) localGet(key string) ([]byte, bool) {
+	g.localMu.Lock()
+	defer g.localMu.Unlock()
+	b, ok := g.local[key]
+	return b, ok
+}
+
+func (g *Gosto) localSet(key string, b []byte) {
+	g.localMu.Lock()
+	defer g.localMu.Unlock()
+	if g.local == nil {
+		g.local = make(map[string][]byte)
+	}
+	g.local[key] = b
+}
+
+func (g *Gosto) localDeleteMulti(keys []string) {
+	g.localMu.Lock()
+	defer g.localMu.Unlock()
+	for _, k := range keys {
+		delete(g.local, k)
+	}
+}
+
+// cacheInvalidateMulti drops keys from both cache tiers. Inside a
+// transaction the invalidation is deferred until the transaction commits,
+// matching goon's two-tier semantics.
+func (g *Gosto) cacheInvalidateMulti(ctx context.Context, keys []*datastore.Key) {
+	if len(keys) == 0 {
+		return
+	}
+	ks := make([]string, len(keys))
+	for i, k := range keys {
+		ks[i] = cacheKey(k)
+	}
+	if g.inTransaction {
+		g.pendingMu.Lock()
+		g.pending = append(g.pending, ks...)
+		g.pendingMu.Unlock()
+		return
+	}
+	g.localDeleteMulti(ks)
+	if g.Cache != nil {
+		g.Cache.DeleteMulti(ctx, ks)
+	}
+}
+
+// cacheGetAll attempts to satisfy every key in keys from the two-tier
+// cache, decoding hits into the corresponding element of v. It reports
+// cached=true only when every key was resolved from cache (whether a hit
+// or a confirmed negative entry); in that case err is GetMulti's final
+// result. A false return means at least one key was a genuine miss or a
+// stale schema entry, and the caller should fall back to Datastore.
+func (g *Gosto) cacheGetAll(ctx context.Context, keys []*datastore.Key, v reflect.Value) (cached bool, err error) {
+	n := len(keys)
+	hits := make([][]byte, n)
+	ks := make([]string, n)
+	for i, k := range keys {
+		ks[i] = cacheKey(k)
+		if b, ok := g.localGet(ks[i]); ok {
+			hits[i] = b
+		}
+	}
+
+	if g.Cache != nil {
+		var need []string
+		for i, b := range hits {
+			if b == nil {
+				need = append(need, ks[i])
+			}
+		}
+		if len(need) > 0 {
+			if found, rerr := g.Cache.GetMulti(ctx, need); rerr == nil {
+				for i, k := range ks {
+					if hits[i] != nil {
+						continue
+					}
+					if b, ok := found[k]; ok {
+						hits[i] = b
+						g.localSet(k, b)
+					}
+				}
+			}
+		}
+	}
+
+	multiErr, anyErr := make(datastore.MultiError, n), false
+	for i, b := range hits {
+		if b == nil {
+			return false, nil
+		}
+		if bytes.Equal(b, cacheNoSuchEntity) {
+			anyErr = true
+			multiErr[i] = datastore.ErrNoSuchEntity
+			continue
+		}
+		ok, derr := decodeCacheEntry(b, cacheEntryPtr(v.Index(i)))
+		if derr != nil || !ok {
+			return false, nil
+		}
+	}
+	if anyErr {
+		return true, realError(multiErr)
+	}
+	return true, nil
+}
+
+// cacheGetOne attempts to resolve a single key from the two-tier cache,
+// decoding a hit into elem. hit is true when the cache had a usable entry
+// for k - a decoded value (negative=false) or a confirmed
+// doesn't-exist marker (negative=true). hit is false for a genuine miss or
+// a stale schema entry, and the caller should fall back to Datastore.
+func (g *Gosto) cacheGetOne(ctx context.Context, k *datastore.Key, elem reflect.Value) (hit, negative bool) {
+	ck := cacheKey(k)
+	b, ok := g.localGet(ck)
+	if !ok && g.Cache != nil {
+		if found, err := g.Cache.GetMulti(ctx, []string{ck}); err == nil {
+			if fb, ok2 := found[ck]; ok2 {
+				b, ok = fb, true
+				g.localSet(ck, b)
+			}
+		}
+	}
+	if !ok {
+		return false, false
+	}
+	if bytes.Equal(b, cacheNoSuchEntity) {
+		return true, true
+	}
+	decOk, derr := decodeCacheEntry(b, cacheEntryPtr(elem))
+	if derr != nil || !decOk {
+		return false, false
+	}
+	return true, false
+}
+
+// cacheSetAll fills both cache tiers with the entities held in v, keyed by
+// keys. Entries that fail to gob-encode are silently skipped - caching is
+// a best-effort accelerator, not a source of truth.
+func (g *Gosto) cacheSetAll(ctx context.Context, keys []*datastore.Key, v reflect.Value) {
+	for i, k := range keys {
+		b, err := encodeCacheEntry(cacheEntryPtr(v.Index(i)))
+		if err != nil {
+			continue
+		}
+		ck := cacheKey(k)
+		g.localSet(ck, b)
+		if g.Cache != nil {
+			g.Cache.SetMulti(ctx, map[string][]byte{ck: b}, putTimeout(len(b)))
+		}
+	}
+}
+
+// cacheSetNegative records key as known not to exist in both cache tiers.
+func (g *Gosto) cacheSetNegative(ctx context.Context, key *datastore.Key) {
+	ck := cacheKey(key)
+	g.localSet(ck, cacheNoSuchEntity)
+	if g.Cache != nil {
+		g.Cache.SetMulti(ctx, map[string][]byte{ck: cacheNoSuchEntity}, MemcachePutTimeoutSmall)
+	}
+}
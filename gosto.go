@@ -1,45 +1,109 @@
 package gosto
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"reflect"
 	"sync"
 
-	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 
 	"cloud.google.com/go/datastore"
+	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
 )
 
 var (
 	// IgnoreFieldMismatch decides whether *datastore.ErrFieldMismatch errors
 	// should be silently ignored. This allows you to easily remove fields from structs.
+	//
+	// Deprecated: this is a process-wide, racy default. Use
+	// WithIgnoreFieldMismatch on NewGostoWithOptions to configure it
+	// per-client instead.
 	IgnoreFieldMismatch = true
 )
 
 // Gosto holds the app engine context and the request memory cache.
 type Gosto struct {
+	// Context is used by the non-Ctx methods (Get, PutMulti, RunInTransaction,
+	// ...) for backward compatibility.
+	//
+	// Deprecated: storing a context.Context on a struct prevents per-call
+	// cancellation, deadlines, and tracing spans from reaching batched
+	// Datastore RPCs. Prefer the ...Ctx methods (GetCtx, PutMultiCtx, ...),
+	// which take a context.Context explicitly.
 	Context       context.Context
-	DSClient      *datastore.Client
+	DSClient      dsiface.Client
 	inTransaction bool
 	// KindNameResolver is used to determine what Kind to give an Entity.
 	// Defaults to DefaultKindName
 	KindNameResolver KindNameResolver
+
+	// Cache is an optional second-tier cache (e.g. RedisCache) consulted
+	// and filled alongside the per-request local tier below. Nil disables
+	// it, leaving only the local tier in effect.
+	Cache Cache
+
+	// ignoreFieldMismatch overrides the package-level IgnoreFieldMismatch
+	// for this client when set via WithIgnoreFieldMismatch. Nil means
+	// "use the package-level default".
+	ignoreFieldMismatch *bool
+
+	// eventualConsistency is applied to queries run through Count, GetAll,
+	// and Run when true, i.e. WithEventualConsistency was used. Otherwise
+	// queries keep the client's own (strong) default.
+	eventualConsistency bool
+
+	local   map[string][]byte
+	localMu sync.Mutex
+
+	// pending holds cache keys invalidated mid-transaction; they're only
+	// applied once the transaction commits.
+	pending   []string
+	pendingMu sync.Mutex
 }
 
 // NewGosto creates a new Gosto object from the given request.
 func NewGosto(ctx context.Context, projectID string) (*Gosto, error) {
-	client, err := datastore.NewClient(ctx, projectID)
-	if err != nil {
-		return nil, errors.Wrap(err, "Gosto: failed to initialize a datastore client.")
+	return NewGostoWithOptions(ctx, projectID)
+}
+
+// ignoreMismatch reports whether g should silently ignore
+// *datastore.ErrFieldMismatch errors, preferring the per-client override
+// from WithIgnoreFieldMismatch over the package-level IgnoreFieldMismatch.
+func (g *Gosto) ignoreMismatch() bool {
+	if g.ignoreFieldMismatch != nil {
+		return *g.ignoreFieldMismatch
 	}
+	return IgnoreFieldMismatch
+}
 
-	return &Gosto{
-		Context:          ctx,
-		DSClient:         client,
-		KindNameResolver: DefaultKindName,
-	}, nil
+// processFieldMismatchError walks err - a datastore.MultiError or a single
+// error - and, when g is configured to ignore field mismatches, replaces
+// each *datastore.ErrFieldMismatch entry with nil so multi-op callers get a
+// partial-success result rather than a whole-batch error.
+func (g *Gosto) processFieldMismatchError(err error) error {
+	if err == nil || !g.ignoreMismatch() {
+		return err
+	}
+	merr, ok := err.(datastore.MultiError)
+	if !ok {
+		if errFieldMismatch(err) {
+			return nil
+		}
+		return err
+	}
+	any := false
+	for i, e := range merr {
+		if errFieldMismatch(e) {
+			merr[i] = nil
+		} else if e != nil {
+			any = true
+		}
+	}
+	if !any {
+		return nil
+	}
+	return merr
 }
 
 func (g *Gosto) extractKeys(src interface{}, putRequest bool) ([]*datastore.Key, error) {
@@ -89,26 +153,60 @@ func (g *Gosto) KeyError(src interface{}) (*datastore.Key, error) {
 	return key, err
 }
 
-// RunInTransaction runs f in a transaction. It calls f with a transaction
-// context tg that f should use for all App Engine operations.
+// RunInTransaction is the same as RunInTransactionCtx, using g.Context.
+//
+// Deprecated: prefer RunInTransactionCtx so caller cancellation and
+// deadlines reach the transaction's RPCs.
+func (g *Gosto) RunInTransaction(f func(tx dsiface.Transaction) error, opts ...datastore.TransactionOption) error {
+	return g.RunInTransactionCtx(g.Context, f, opts...)
+}
+
+// RunInTransactionCtx runs f in a transaction. It calls f with a
+// dsiface.Transaction that f should use for all App Engine operations, so
+// that code exercised against gostotest's fake transaction behaves
+// identically to the real thing.
 //
 // Otherwise similar to appengine/datastore.RunInTransaction:
 // https://developers.google.com/appengine/docs/go/datastore/reference#RunInTransaction
-func (g *Gosto) RunInTransaction(f func(tx *datastore.Transaction) error, opts ...datastore.TransactionOption) error {
-	_, err := g.DSClient.RunInTransaction(g.Context, func(tx *datastore.Transaction) error {
-		return f(tx)
-	}, opts...)
+func (g *Gosto) RunInTransactionCtx(ctx context.Context, f func(tx dsiface.Transaction) error, opts ...datastore.TransactionOption) error {
+	g.inTransaction = true
+	defer func() { g.inTransaction = false }()
+
+	_, err := g.DSClient.RunInTransaction(ctx, f, opts...)
+
+	g.pendingMu.Lock()
+	pending := g.pending
+	g.pending = nil
+	g.pendingMu.Unlock()
+
 	if err != nil {
 		return err
 	}
+
+	// Only invalidate the cache once the transaction has actually
+	// committed - an aborted transaction must leave the cache untouched.
+	if len(pending) > 0 {
+		g.localDeleteMulti(pending)
+		if g.Cache != nil {
+			g.Cache.DeleteMulti(ctx, pending)
+		}
+	}
 	return nil
 }
 
-// Put saves the entity src into the datastore based on src's key k. If k
+// Put is the same as PutCtx, using g.Context.
+//
+// Deprecated: prefer PutCtx so caller cancellation and deadlines reach the
+// underlying Datastore RPC.
+func (g *Gosto) Put(src interface{}) (*datastore.Key, error) {
+	return g.PutCtx(g.Context, src)
+}
+
+// PutCtx saves the entity src into the datastore based on src's key k. If k
 // is an incomplete key, the returned key will be a unique key generated by
 // the datastore.
-func (g *Gosto) Put(src interface{}) (*datastore.Key, error) {
-	ks, err := g.PutMulti([]interface{}{src})
+func (g *Gosto) PutCtx(ctx context.Context, src interface{}) (*datastore.Key, error) {
+	ks, err := g.PutMultiCtx(ctx, []interface{}{src})
 	if err != nil {
 		if me, ok := err.(datastore.MultiError); ok {
 			return nil, me[0]
@@ -118,13 +216,26 @@ func (g *Gosto) Put(src interface{}) (*datastore.Key, error) {
 	return ks[0], nil
 }
 
+// maxConcurrentShards caps how many putMultiLimit/getMultiLimit/
+// deleteMultiLimit-sized shards run concurrently, so a batch of e.g.
+// 100k keys doesn't spawn 100 concurrent RPCs.
+const maxConcurrentShards = 8
+
 const putMultiLimit = 500
 
-// PutMulti is a batch version of Put.
+// PutMulti is the same as PutMultiCtx, using g.Context.
+//
+// Deprecated: prefer PutMultiCtx so caller cancellation and deadlines reach
+// each shard's Datastore RPC.
+func (g *Gosto) PutMulti(src interface{}) ([]*datastore.Key, error) {
+	return g.PutMultiCtx(g.Context, src)
+}
+
+// PutMultiCtx is a batch version of PutCtx.
 //
 // src must be a *[]S, *[]*S, *[]I, []S, []*S, or []I, for some struct type S,
 // or some interface type I. If *[]I or []I, each element must be a struct pointer.
-func (g *Gosto) PutMulti(src interface{}) ([]*datastore.Key, error) {
+func (g *Gosto) PutMultiCtx(ctx context.Context, src interface{}) ([]*datastore.Key, error) {
 	keys, err := g.extractKeys(src, true) // allow incomplete keys on a Put request
 	if err != nil {
 		return nil, err
@@ -134,17 +245,18 @@ func (g *Gosto) PutMulti(src interface{}) ([]*datastore.Key, error) {
 	mu := new(sync.Mutex)
 	multiErr, any := make(datastore.MultiError, len(keys)), false
 	goroutines := (len(keys)-1)/putMultiLimit + 1
-	var wg sync.WaitGroup
-	wg.Add(goroutines)
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(maxConcurrentShards)
 	for i := 0; i < goroutines; i++ {
-		go func(i int) {
-			defer wg.Done()
+		i := i
+		eg.Go(func() error {
 			lo := i * putMultiLimit
 			hi := (i + 1) * putMultiLimit
 			if hi > len(keys) {
 				hi = len(keys)
 			}
-			rkeys, pmerr := datastore.PutMulti(keys[lo:hi], v.Slice(lo, hi).Interface())
+			rkeys, pmerr := g.DSClient.PutMulti(egCtx, keys[lo:hi], v.Slice(lo, hi).Interface())
 			if pmerr != nil {
 				mu.Lock()
 				any = true // this flag tells PutMulti to return multiErr later
@@ -154,13 +266,30 @@ func (g *Gosto) PutMulti(src interface{}) ([]*datastore.Key, error) {
 					for j := lo; j < hi; j++ {
 						multiErr[j] = pmerr
 					}
-					return
+					return pmerr
 				}
 				copy(multiErr[lo:hi], merr)
+				return pmerr
 			}
-		}(i)
+			// Hand back the keys Datastore assigned, so incomplete keys
+			// come back complete.
+			copy(keys[lo:hi], rkeys)
+			return nil
+		})
+	}
+	// The shard errors that matter are already captured in multiErr; eg.Wait
+	// only tells us whether to cancel siblings, which it already did.
+	_ = eg.Wait()
+
+	// Invalidate the keys whose shard actually succeeded, even if a
+	// sibling shard failed; multiErr[i] == nil means keys[i] was written.
+	var okKeys []*datastore.Key
+	for i, k := range keys {
+		if multiErr[i] == nil {
+			okKeys = append(okKeys, k)
+		}
 	}
-	wg.Wait()
+	g.cacheInvalidateMulti(ctx, okKeys)
 
 	if any {
 		return keys, realError(multiErr)
@@ -168,10 +297,17 @@ func (g *Gosto) PutMulti(src interface{}) ([]*datastore.Key, error) {
 	return keys, nil
 }
 
-// Get loads the entity based on dst's key into dst
-// If there is no such entity for the key, Get returns
-// datastore.ErrNoSuchEntity.
+// Get is the same as GetCtx, using g.Context.
+//
+// Deprecated: prefer GetCtx so caller cancellation and deadlines reach the
+// underlying Datastore RPC.
 func (g *Gosto) Get(dst interface{}) error {
+	return g.GetCtx(g.Context, dst)
+}
+
+// GetCtx loads the entity based on dst's key into dst. If there is no such
+// entity for the key, GetCtx returns datastore.ErrNoSuchEntity.
+func (g *Gosto) GetCtx(ctx context.Context, dst interface{}) error {
 	set := reflect.ValueOf(dst)
 	if set.Kind() != reflect.Ptr {
 		return fmt.Errorf("Gosto: expected pointer to a struct, got %#v", dst)
@@ -180,7 +316,7 @@ func (g *Gosto) Get(dst interface{}) error {
 		set = set.Elem()
 	}
 	dsts := []interface{}{dst}
-	if err := g.GetMulti(dsts); err != nil {
+	if err := g.GetMultiCtx(ctx, dsts); err != nil {
 		// Look for an embedded error if it's multi
 		if me, ok := err.(datastore.MultiError); ok {
 			return me[0]
@@ -194,11 +330,19 @@ func (g *Gosto) Get(dst interface{}) error {
 
 const getMultiLimit = 1000
 
-// GetMulti is a batch version of Get.
+// GetMulti is the same as GetMultiCtx, using g.Context.
+//
+// Deprecated: prefer GetMultiCtx so caller cancellation and deadlines reach
+// each shard's Datastore RPC.
+func (g *Gosto) GetMulti(dst interface{}) error {
+	return g.GetMultiCtx(g.Context, dst)
+}
+
+// GetMultiCtx is a batch version of GetCtx.
 //
 // dst must be a *[]S, *[]*S, *[]I, []S, []*S, or []I, for some struct type S,
 // or some interface type I. If *[]I or []I, each element must be a struct pointer.
-func (g *Gosto) GetMulti(dst interface{}) error {
+func (g *Gosto) GetMultiCtx(ctx context.Context, dst interface{}) error {
 	keys, err := g.extractKeys(dst, false) // don't allow incomplete keys on a Get request
 	if err != nil {
 		return err
@@ -210,85 +354,108 @@ func (g *Gosto) GetMulti(dst interface{}) error {
 
 	if g.inTransaction {
 		// todo: support getMultiLimit in transactions
-		if err := datastore.GetMulti(g.Context, keys, v.Interface()); err != nil {
-			if merr, ok := err.(datastore.MultiError); ok {
-				for i := 0; i < len(keys); i++ {
-					if merr[i] != nil && (!IgnoreFieldMismatch || !errFieldMismatch(merr[i])) {
-						anyErr = true // this flag tells GetMulti to return multiErr later
-						multiErr[i] = merr[i]
-					}
-				}
-			} else {
-				anyErr = true // this flag tells GetMulti to return multiErr later
-				for i := 0; i < len(keys); i++ {
-					multiErr[i] = err
-				}
-			}
-			if anyErr {
-				return realError(multiErr)
+		if err := g.DSClient.GetMulti(ctx, keys, v.Interface()); err != nil {
+			if err := g.processFieldMismatchError(err); err != nil {
+				return err
 			}
 		}
 		return nil
 	}
 
+	// If every key is already resolvable from the two-tier cache (a hit or
+	// a confirmed negative entry), skip Datastore entirely.
+	if cached, cerr := g.cacheGetAll(ctx, keys, v); cached {
+		return cerr
+	}
+
+	// Resolve as many keys as possible from the cache individually, and
+	// ship only the remainder to Datastore.
 	var dskeys []*datastore.Key
 	var dsdst []interface{}
 	var dixs []int
+	for i, k := range keys {
+		hit, negative := g.cacheGetOne(ctx, k, v.Index(i))
+		if !hit {
+			dskeys = append(dskeys, k)
+			dsdst = append(dsdst, cacheEntryPtr(v.Index(i)))
+			dixs = append(dixs, i)
+			continue
+		}
+		if negative {
+			anyErr = true
+			multiErr[i] = datastore.ErrNoSuchEntity
+		}
+	}
 
-	var mixs []int
+	if len(dskeys) == 0 {
+		if anyErr {
+			return realError(multiErr)
+		}
+		return nil
+	}
 
 	mu := new(sync.Mutex)
 	goroutines := (len(dskeys)-1)/getMultiLimit + 1
-	var wg sync.WaitGroup
-	wg.Add(goroutines)
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(maxConcurrentShards)
 	for i := 0; i < goroutines; i++ {
-		go func(i int) {
-			defer wg.Done()
-			var toCache []interface{}
-			var exists []byte
+		i := i
+		eg.Go(func() error {
 			lo := i * getMultiLimit
 			hi := (i + 1) * getMultiLimit
 			if hi > len(dskeys) {
 				hi = len(dskeys)
 			}
-			gmerr := datastore.GetMulti(g.Context, dskeys[lo:hi], dsdst[lo:hi])
-			if gmerr != nil {
-				mu.Lock()
-				anyErr = true // this flag tells GetMulti to return multiErr later
-				mu.Unlock()
-				merr, ok := gmerr.(datastore.MultiError)
-				if !ok {
-					for j := lo; j < hi; j++ {
-						multiErr[j] = gmerr
-					}
-					return
+			gmerr := g.DSClient.GetMulti(egCtx, dskeys[lo:hi], dsdst[lo:hi])
+			if gmerr == nil {
+				return nil
+			}
+			mu.Lock()
+			anyErr = true // this flag tells GetMulti to return multiErr later
+			mu.Unlock()
+			merr, ok := gmerr.(datastore.MultiError)
+			if !ok {
+				for j := lo; j < hi; j++ {
+					multiErr[dixs[j]] = gmerr
 				}
-				for i, idx := range dixs[lo:hi] {
-					if merr[i] == nil || (IgnoreFieldMismatch && errFieldMismatch(merr[i])) {
-						exists = append(exists, 1)
-					} else {
-						if merr[i] == datastore.ErrNoSuchEntity {
-							exists = append(exists, 0)
-						}
-						multiErr[idx] = merr[i]
-					}
+				return gmerr
+			}
+			for j := lo; j < hi; j++ {
+				e := merr[j-lo]
+				if e == nil || (g.ignoreMismatch() && errFieldMismatch(e)) {
+					continue
 				}
-			} else {
-				exists = append(exists, bytes.Repeat([]byte{1}, hi-lo)...)
+				multiErr[dixs[j]] = e
 			}
-		}(i)
+			return gmerr
+		})
 	}
-	wg.Wait()
+	_ = eg.Wait()
 	if anyErr {
+		for i, k := range keys {
+			if multiErr[i] == datastore.ErrNoSuchEntity {
+				g.cacheSetNegative(ctx, k)
+			}
+		}
 		return realError(multiErr)
 	}
+	g.cacheSetAll(ctx, keys, v)
 	return nil
 }
 
-// Delete deletes the entity for the given key.
+// Delete is the same as DeleteCtx, using g.Context.
+//
+// Deprecated: prefer DeleteCtx so caller cancellation and deadlines reach
+// the underlying Datastore RPC.
 func (g *Gosto) Delete(key *datastore.Key) error {
+	return g.DeleteCtx(g.Context, key)
+}
+
+// DeleteCtx deletes the entity for the given key.
+func (g *Gosto) DeleteCtx(ctx context.Context, key *datastore.Key) error {
 	keys := []*datastore.Key{key}
-	err := g.DeleteMulti(keys)
+	err := g.DeleteMultiCtx(ctx, keys)
 	if me, ok := err.(datastore.MultiError); ok {
 		return me[0]
 	}
@@ -328,8 +495,16 @@ func realError(multiError datastore.MultiError) error {
 	return init
 }
 
-// DeleteMulti is a batch version of Delete.
+// DeleteMulti is the same as DeleteMultiCtx, using g.Context.
+//
+// Deprecated: prefer DeleteMultiCtx so caller cancellation and deadlines
+// reach each shard's Datastore RPC.
 func (g *Gosto) DeleteMulti(keys []*datastore.Key) error {
+	return g.DeleteMultiCtx(g.Context, keys)
+}
+
+// DeleteMultiCtx is a batch version of DeleteCtx.
+func (g *Gosto) DeleteMultiCtx(ctx context.Context, keys []*datastore.Key) error {
 	if len(keys) == 0 {
 		return nil
 	}
@@ -337,17 +512,18 @@ func (g *Gosto) DeleteMulti(keys []*datastore.Key) error {
 	mu := new(sync.Mutex)
 	multiErr, any := make(datastore.MultiError, len(keys)), false
 	goroutines := (len(keys)-1)/deleteMultiLimit + 1
-	var wg sync.WaitGroup
-	wg.Add(goroutines)
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(maxConcurrentShards)
 	for i := 0; i < goroutines; i++ {
-		go func(i int) {
-			defer wg.Done()
+		i := i
+		eg.Go(func() error {
 			lo := i * deleteMultiLimit
 			hi := (i + 1) * deleteMultiLimit
 			if hi > len(keys) {
 				hi = len(keys)
 			}
-			dmerr := datastore.DeleteMulti(g.Context, keys[lo:hi])
+			dmerr := g.DSClient.DeleteMulti(egCtx, keys[lo:hi])
 			if dmerr != nil {
 				mu.Lock()
 				any = true // this flag tells DeleteMulti to return multiErr later
@@ -357,13 +533,26 @@ func (g *Gosto) DeleteMulti(keys []*datastore.Key) error {
 					for j := lo; j < hi; j++ {
 						multiErr[j] = dmerr
 					}
-					return
+					return dmerr
 				}
 				copy(multiErr[lo:hi], merr)
+				return dmerr
 			}
-		}(i)
+			return nil
+		})
 	}
-	wg.Wait()
+	_ = eg.Wait()
+
+	// Invalidate the keys whose shard actually succeeded, even if a
+	// sibling shard failed; multiErr[i] == nil means keys[i] was deleted.
+	var okKeys []*datastore.Key
+	for i, k := range keys {
+		if multiErr[i] == nil {
+			okKeys = append(okKeys, k)
+		}
+	}
+	g.cacheInvalidateMulti(ctx, okKeys)
+
 	if any {
 		return realError(multiErr)
 	}
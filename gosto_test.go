@@ -0,0 +1,61 @@
+package gosto
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/timakin/gosto/gostotest"
+)
+
+type shardTestEntity struct {
+	ID   int64 `datastore:"-" goon:"id"`
+	Name string
+}
+
+// TestGetMultiCtxShardsAcrossLimit exercises GetMultiCtx/PutMultiCtx/
+// DeleteMultiCtx with more keys than getMultiLimit, guarding against the
+// dskeys/dsdst/dixs population bug where GetMulti silently returned nil
+// without ever calling Datastore.
+func TestGetMultiCtxShardsAcrossLimit(t *testing.T) {
+	ctx := context.Background()
+	g, err := NewGostoWithOptions(ctx, "test-project", WithClient(gostotest.NewFakeClient()))
+	if err != nil {
+		t.Fatalf("NewGostoWithOptions: %v", err)
+	}
+
+	const n = getMultiLimit + putMultiLimit + 7 // force several shards
+	puts := make([]*shardTestEntity, n)
+	for i := 0; i < n; i++ {
+		puts[i] = &shardTestEntity{ID: int64(i + 1), Name: fmt.Sprintf("entity-%d", i)}
+	}
+	if _, err := g.PutMultiCtx(ctx, puts); err != nil {
+		t.Fatalf("PutMultiCtx: %v", err)
+	}
+
+	gets := make([]*shardTestEntity, n)
+	for i := range gets {
+		gets[i] = &shardTestEntity{ID: int64(i + 1)}
+	}
+	if err := g.GetMultiCtx(ctx, gets); err != nil {
+		t.Fatalf("GetMultiCtx: %v", err)
+	}
+	for i, e := range gets {
+		if want := fmt.Sprintf("entity-%d", i); e.Name != want {
+			t.Fatalf("gets[%d].Name = %q, want %q", i, e.Name, want)
+		}
+	}
+
+	keys := make([]*datastore.Key, len(gets))
+	for i, e := range gets {
+		keys[i] = g.Key(e)
+	}
+	if err := g.DeleteMultiCtx(ctx, keys); err != nil {
+		t.Fatalf("DeleteMultiCtx: %v", err)
+	}
+
+	if err := g.GetMultiCtx(ctx, gets); err == nil {
+		t.Fatal("GetMultiCtx after DeleteMultiCtx: got nil error, want ErrNoSuchEntity")
+	}
+}
@@ -0,0 +1,752 @@
+// Package gostotest provides an in-memory fake of dsiface.Client for
+// exercising gosto (and code that calls it) without a live Datastore
+// emulator.
+package gostotest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"unsafe"
+
+	"cloud.google.com/go/datastore"
+	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
+	"google.golang.org/api/iterator"
+)
+
+// entities maps kind -> key-string -> gob-encoded entity, the shape
+// FakeClient persists. props mirrors it with a kind -> key-string ->
+// field-name -> value index built from the same Put, used to evaluate
+// query filters/orders without having to know an entity's concrete type
+// up front (gob can't decode into a generic map the way the real
+// protobuf-backed Datastore wire format can).
+type entities map[string]map[string][]byte
+type props map[string]map[string]map[string]interface{}
+
+// FakeClient is a dsiface.Client backed by an in-memory store, gob-encoding
+// entities the way a real round trip through Datastore would. It is safe
+// for concurrent use.
+//
+// dsiface.Client is embedded, rather than fully hand-implemented, per its
+// own doc comment: embedding picks up the sealed marker method that
+// prevents other packages from implementing it directly, so FakeClient
+// keeps compiling if dsiface.Client grows new methods. The embedded value
+// is always nil; every method dsiface.Client actually declares is
+// overridden below.
+type FakeClient struct {
+	dsiface.Client
+
+	mu    sync.Mutex
+	store entities
+	props props
+	seq   int64
+}
+
+var _ dsiface.Client = (*FakeClient)(nil)
+
+// NewFakeClient returns an empty FakeClient ready for use.
+func NewFakeClient() *FakeClient {
+	return &FakeClient{store: make(entities), props: make(props)}
+}
+
+func entityBytes(src interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(src); err != nil {
+		return nil, fmt.Errorf("gostotest: failed to encode entity: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// entityProps extracts the exported fields of the struct (or struct
+// pointer) src into a flat name->value map for query evaluation.
+func entityProps(src interface{}) map[string]interface{} {
+	v := reflect.Indirect(reflect.ValueOf(src))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	t := v.Type()
+	out := make(map[string]interface{}, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		out[f.Name] = v.Field(i).Interface()
+	}
+	return out
+}
+
+// multiElemPtr returns a pointer suitable for Get/Put to the i'th element
+// of v, mirroring how the real datastore.Client treats a GetMulti/PutMulti
+// dst/src of []S, []*S, or []I: a value-struct element ([]S) needs Addr()
+// to get a pointer, while a pointer or interface element ([]*S or []I)
+// already holds one and must be used as-is - taking its Addr() would
+// produce a **S/*I instead of the *S the rest of FakeClient expects.
+func multiElemPtr(v reflect.Value, i int) interface{} {
+	elem := v.Index(i)
+	switch elem.Kind() {
+	case reflect.Ptr:
+		if elem.IsNil() && elem.CanSet() {
+			elem.Set(reflect.New(elem.Type().Elem()))
+		}
+		return elem.Interface()
+	case reflect.Interface:
+		return elem.Interface()
+	default:
+		return elem.Addr().Interface()
+	}
+}
+
+func (c *FakeClient) allocateIDLocked(k *datastore.Key) *datastore.Key {
+	c.seq++
+	return datastore.IDKey(k.Kind, c.seq, k.Parent)
+}
+
+func (c *FakeClient) putLocked(store entities, p props, k *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if k.Incomplete() {
+		k = c.allocateIDLocked(k)
+	}
+	b, err := entityBytes(src)
+	if err != nil {
+		return nil, err
+	}
+	if store[k.Kind] == nil {
+		store[k.Kind] = make(map[string][]byte)
+	}
+	if p[k.Kind] == nil {
+		p[k.Kind] = make(map[string]map[string]interface{})
+	}
+	ks := k.Encode()
+	store[k.Kind][ks] = b
+	p[k.Kind][ks] = entityProps(src)
+	return k, nil
+}
+
+func (c *FakeClient) getLocked(store entities, k *datastore.Key, dst interface{}) error {
+	b, ok := store[k.Kind][k.Encode()]
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(dst); err != nil {
+		return fmt.Errorf("gostotest: failed to decode entity: %w", err)
+	}
+	return nil
+}
+
+func (c *FakeClient) deleteLocked(store entities, p props, k *datastore.Key) {
+	ks := k.Encode()
+	delete(store[k.Kind], ks)
+	delete(p[k.Kind], ks)
+}
+
+// compareKeys orders a and b the way Datastore orders keys: by ancestor
+// path from root to leaf, comparing each path element by Kind and then by
+// ID (numerically) or Name (lexically). Key.Encode() must NOT be used for
+// this - it's an opaque base64-of-protobuf blob with no relation to
+// numeric ID or string Name order.
+func compareKeys(a, b *datastore.Key) int {
+	ap, bp := keyPath(a), keyPath(b)
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		if c := compareKeyElem(ap[i], bp[i]); c != 0 {
+			return c
+		}
+	}
+	return len(ap) - len(bp)
+}
+
+// keyPath returns k's ancestor chain from root to k itself.
+func keyPath(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
+
+// compareKeyElem orders two keys at the same ancestor depth by Kind, then
+// by ID/Name: a numeric ID sorts before any string Name, and within the
+// same kind of identifier, IDs compare numerically and Names lexically.
+func compareKeyElem(a, b *datastore.Key) int {
+	if a.Kind != b.Kind {
+		if a.Kind < b.Kind {
+			return -1
+		}
+		return 1
+	}
+	aID, bID := a.Name == "", b.Name == ""
+	if aID != bID {
+		if aID {
+			return -1
+		}
+		return 1
+	}
+	if aID {
+		switch {
+		case a.ID < b.ID:
+			return -1
+		case a.ID > b.ID:
+			return 1
+		default:
+			return 0
+		}
+	}
+	switch {
+	case a.Name < b.Name:
+		return -1
+	case a.Name > b.Name:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Get implements dsiface.Client.
+func (c *FakeClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.getLocked(c.store, key, dst)
+}
+
+// GetMulti implements dsiface.Client.
+func (c *FakeClient) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(dst))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	merr, any := make(datastore.MultiError, len(keys)), false
+	for i, k := range keys {
+		if err := c.getLocked(c.store, k, multiElemPtr(v, i)); err != nil {
+			merr[i] = err
+			any = true
+		}
+	}
+	if any {
+		return merr
+	}
+	return nil
+}
+
+// Put implements dsiface.Client.
+func (c *FakeClient) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.putLocked(c.store, c.props, key, src)
+}
+
+// PutMulti implements dsiface.Client.
+func (c *FakeClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	v := reflect.Indirect(reflect.ValueOf(src))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make([]*datastore.Key, len(keys))
+	merr, any := make(datastore.MultiError, len(keys)), false
+	for i, k := range keys {
+		nk, err := c.putLocked(c.store, c.props, k, multiElemPtr(v, i))
+		if err != nil {
+			merr[i] = err
+			any = true
+			continue
+		}
+		out[i] = nk
+	}
+	if any {
+		return out, merr
+	}
+	return out, nil
+}
+
+// Delete implements dsiface.Client.
+func (c *FakeClient) Delete(ctx context.Context, key *datastore.Key) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deleteLocked(c.store, c.props, key)
+	return nil
+}
+
+// DeleteMulti implements dsiface.Client.
+func (c *FakeClient) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		c.deleteLocked(c.store, c.props, k)
+	}
+	return nil
+}
+
+// AllocateIDs implements dsiface.Client.
+func (c *FakeClient) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		out[i] = c.allocateIDLocked(k)
+	}
+	return out, nil
+}
+
+// Mutate implements dsiface.Client. datastore.Mutation's operation and
+// encoded entity are private to the datastore package, so there's no way
+// to recover them here; use Put/PutMulti/Delete/DeleteMulti instead.
+func (c *FakeClient) Mutate(ctx context.Context, muts ...*datastore.Mutation) ([]*datastore.Key, error) {
+	return nil, fmt.Errorf("gostotest: Mutate is not supported by FakeClient; use Put/PutMulti/Delete/DeleteMulti instead")
+}
+
+// Count implements dsiface.Client.
+func (c *FakeClient) Count(ctx context.Context, q *datastore.Query) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	matches, _, err := c.runQueryLocked(q)
+	if err != nil {
+		return 0, err
+	}
+	return len(matches), nil
+}
+
+// GetAll implements dsiface.Client.
+func (c *FakeClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	c.mu.Lock()
+	matches, _, err := c.runQueryLocked(q)
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*datastore.Key, len(matches))
+	for i, m := range matches {
+		keys[i] = m.key
+	}
+	if dst == nil {
+		return keys, nil
+	}
+
+	v := reflect.ValueOf(dst).Elem()
+	elemType := v.Type().Elem()
+	ptr := elemType.Kind() == reflect.Ptr
+	if ptr {
+		elemType = elemType.Elem()
+	}
+	for _, m := range matches {
+		ev := reflect.New(elemType)
+		if err := gob.NewDecoder(bytes.NewReader(m.data)).Decode(ev.Interface()); err != nil {
+			return nil, fmt.Errorf("gostotest: failed to decode entity: %w", err)
+		}
+		if ptr {
+			v.Set(reflect.Append(v, ev))
+		} else {
+			v.Set(reflect.Append(v, ev.Elem()))
+		}
+	}
+	return keys, nil
+}
+
+// Run implements dsiface.Client.
+func (c *FakeClient) Run(ctx context.Context, q *datastore.Query) dsiface.Iterator {
+	c.mu.Lock()
+	matches, base, err := c.runQueryLocked(q)
+	c.mu.Unlock()
+	return &fakeIterator{matches: matches, base: base, err: err}
+}
+
+// fakeIterator implements dsiface.Iterator. dsiface.Iterator is embedded
+// for the same sealed-marker reason as FakeClient; the embedded value is
+// always nil.
+type fakeIterator struct {
+	dsiface.Iterator
+
+	matches []queryMatch
+	idx     int
+	// base is the absolute offset, across the query's full (unpaginated)
+	// match set, of matches[0] - i.e. how many results q.Start's cursor
+	// already skipped. Cursor() adds it back in so a cursor handed out
+	// mid-iteration resumes at the right global position.
+	base int
+	err  error
+}
+
+func (it *fakeIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if it.idx >= len(it.matches) {
+		return nil, iterator.Done
+	}
+	m := it.matches[it.idx]
+	it.idx++
+	if dst != nil {
+		if err := gob.NewDecoder(bytes.NewReader(m.data)).Decode(dst); err != nil {
+			return nil, fmt.Errorf("gostotest: failed to decode entity: %w", err)
+		}
+	}
+	return m.key, nil
+}
+
+// Cursor implements dsiface.Iterator, encoding the iterator's current
+// position as a cursor accepted by (*datastore.Query).Start.
+func (it *fakeIterator) Cursor() (datastore.Cursor, error) {
+	return encodeFakeCursor(it.base + it.idx), nil
+}
+
+// encodeFakeCursor packs offset, the absolute position of a match within a
+// query's full result set, into a datastore.Cursor. datastore.Cursor's
+// backing bytes are private to the datastore package, so DecodeCursor -
+// its one exported constructor - is repurposed here: base64-encoding
+// offset first means decoding it back out hands back exactly those bytes.
+func encodeFakeCursor(offset int) datastore.Cursor {
+	c, _ := datastore.DecodeCursor(base64.URLEncoding.EncodeToString([]byte(strconv.Itoa(offset))))
+	return c
+}
+
+// decodeFakeCursor is encodeFakeCursor's inverse, recovering the absolute
+// offset from a query's start cursor bytes. An empty cursor (no Start
+// call) decodes to offset 0.
+func decodeFakeCursor(cc []byte) (int, error) {
+	if len(cc) == 0 {
+		return 0, nil
+	}
+	offset, err := strconv.Atoi(string(cc))
+	if err != nil {
+		return 0, fmt.Errorf("gostotest: unrecognized cursor: %w", err)
+	}
+	return offset, nil
+}
+
+// NewTransaction implements dsiface.Client. The returned transaction runs
+// against a copy-on-write snapshot of the store; the snapshot only
+// replaces the real store once Commit is called, so a rolled-back
+// transaction leaves the client untouched.
+func (c *FakeClient) NewTransaction(ctx context.Context, opts ...datastore.TransactionOption) (dsiface.Transaction, error) {
+	c.mu.Lock()
+	storeSnap := cloneEntities(c.store)
+	propsSnap := cloneProps(c.props)
+	c.mu.Unlock()
+
+	return &fakeTransaction{
+		client:  c,
+		store:   storeSnap,
+		props:   propsSnap,
+		pending: make(map[*datastore.PendingKey]*datastore.Key),
+	}, nil
+}
+
+// RunInTransaction implements dsiface.Client.
+func (c *FakeClient) RunInTransaction(ctx context.Context, f func(tx dsiface.Transaction) error, opts ...datastore.TransactionOption) (dsiface.Commit, error) {
+	tx, err := c.NewTransaction(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx.Commit()
+}
+
+func cloneEntities(src entities) entities {
+	dst := make(entities, len(src))
+	for kind, byKey := range src {
+		cp := make(map[string][]byte, len(byKey))
+		for k, v := range byKey {
+			cp[k] = v
+		}
+		dst[kind] = cp
+	}
+	return dst
+}
+
+func cloneProps(src props) props {
+	dst := make(props, len(src))
+	for kind, byKey := range src {
+		cp := make(map[string]map[string]interface{}, len(byKey))
+		for k, v := range byKey {
+			cp[k] = v
+		}
+		dst[kind] = cp
+	}
+	return dst
+}
+
+// fakeTransaction implements dsiface.Transaction against a private,
+// copy-on-write snapshot of the client's store. dsiface.Transaction is
+// embedded for the same sealed-marker reason as FakeClient; the embedded
+// value is always nil.
+type fakeTransaction struct {
+	dsiface.Transaction
+
+	client  *FakeClient
+	store   entities
+	props   props
+	pending map[*datastore.PendingKey]*datastore.Key
+}
+
+// newPendingKey fabricates a *datastore.PendingKey to satisfy the
+// dsiface.Transaction signature. Its fields are never read - fakeCommit
+// resolves it back to a real key through the pending map instead, since
+// datastore.PendingKey exposes no exported fields or constructor outside
+// its own package.
+func newPendingKey(k *datastore.Key) *datastore.PendingKey {
+	return reflect.New(reflect.TypeOf(datastore.PendingKey{})).Interface().(*datastore.PendingKey)
+}
+
+func (t *fakeTransaction) Get(key *datastore.Key, dst interface{}) error {
+	return t.client.getLocked(t.store, key, dst)
+}
+
+func (t *fakeTransaction) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(dst))
+	merr, any := make(datastore.MultiError, len(keys)), false
+	for i, k := range keys {
+		if err := t.client.getLocked(t.store, k, multiElemPtr(v, i)); err != nil {
+			merr[i] = err
+			any = true
+		}
+	}
+	if any {
+		return merr
+	}
+	return nil
+}
+
+func (t *fakeTransaction) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	nk, err := t.client.putLocked(t.store, t.props, key, src)
+	if err != nil {
+		return nil, err
+	}
+	pk := newPendingKey(nk)
+	t.pending[pk] = nk
+	return pk, nil
+}
+
+func (t *fakeTransaction) PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.PendingKey, error) {
+	v := reflect.Indirect(reflect.ValueOf(src))
+	out := make([]*datastore.PendingKey, len(keys))
+	merr, any := make(datastore.MultiError, len(keys)), false
+	for i, k := range keys {
+		nk, err := t.client.putLocked(t.store, t.props, k, multiElemPtr(v, i))
+		if err != nil {
+			merr[i] = err
+			any = true
+			continue
+		}
+		pk := newPendingKey(nk)
+		t.pending[pk] = nk
+		out[i] = pk
+	}
+	if any {
+		return out, merr
+	}
+	return out, nil
+}
+
+func (t *fakeTransaction) Delete(key *datastore.Key) error {
+	t.client.deleteLocked(t.store, t.props, key)
+	return nil
+}
+
+func (t *fakeTransaction) DeleteMulti(keys []*datastore.Key) error {
+	for _, k := range keys {
+		t.client.deleteLocked(t.store, t.props, k)
+	}
+	return nil
+}
+
+// Mutate implements dsiface.Transaction. Not supported, for the same
+// reason as FakeClient.Mutate.
+func (t *fakeTransaction) Mutate(muts ...*datastore.Mutation) ([]*datastore.PendingKey, error) {
+	return nil, fmt.Errorf("gostotest: Mutate is not supported by FakeClient; use Put/PutMulti/Delete/DeleteMulti instead")
+}
+
+// Commit implements dsiface.Transaction, replacing the client's store with
+// the transaction's snapshot.
+func (t *fakeTransaction) Commit() (dsiface.Commit, error) {
+	t.client.mu.Lock()
+	t.client.store = t.store
+	t.client.props = t.props
+	t.client.mu.Unlock()
+	return &fakeCommit{pending: t.pending}, nil
+}
+
+// Rollback implements dsiface.Transaction. The transaction's snapshot is
+// simply discarded, leaving the client's store untouched.
+func (t *fakeTransaction) Rollback() error {
+	return nil
+}
+
+// fakeCommit implements dsiface.Commit, resolving the *datastore.PendingKey
+// values handed out during the transaction to their final keys.
+// dsiface.Commit is embedded for the same sealed-marker reason as
+// FakeClient; the embedded value is always nil.
+type fakeCommit struct {
+	dsiface.Commit
+
+	pending map[*datastore.PendingKey]*datastore.Key
+}
+
+func (c *fakeCommit) Key(pk *datastore.PendingKey) *datastore.Key {
+	return c.pending[pk]
+}
+
+// Close implements dsiface.Client.
+func (c *FakeClient) Close() error { return nil }
+
+// queryMatch is one entity that satisfied a query.
+type queryMatch struct {
+	key  *datastore.Key
+	data []byte
+}
+
+// runQueryLocked evaluates q against the client's current store, returning
+// the matches plus the absolute offset (within the full, unpaginated
+// result set) of matches[0] - the base fakeIterator.Cursor needs to hand
+// out cursors that resume at the right place. It supports filtering by
+// kind and ancestor, a single equality filter, a single sort order, a
+// start cursor, and a limit - the "basic" subset of query.go's
+// functionality, sufficient for table-driven tests. Range filters, OR
+// queries, and projections are not supported. Callers must hold c.mu.
+func (c *FakeClient) runQueryLocked(q *datastore.Query) (matches []queryMatch, base int, err error) {
+	info, err := parseQuery(q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for kind, byKey := range c.store {
+		if info.kind != "" && kind != info.kind {
+			continue
+		}
+		for ks, data := range byKey {
+			key, err := datastore.DecodeKey(ks)
+			if err != nil {
+				return nil, 0, err
+			}
+			if info.ancestor != nil && !keyHasAncestor(key, info.ancestor) {
+				continue
+			}
+			if info.filterField != "" {
+				got := c.props[kind][ks][info.filterField]
+				if fmt.Sprint(got) != fmt.Sprint(info.filterValue) {
+					continue
+				}
+			}
+			matches = append(matches, queryMatch{key: key, data: data})
+		}
+	}
+
+	// Sort by key first, so the result set has a stable order across
+	// repeated runs against the same data - required for a start cursor's
+	// offset to mean the same thing from one page to the next - then, if
+	// requested, stable-sort on top of that by the query's order field.
+	// This must be a real key ordering, not Key.Encode() string
+	// comparison: Encode() is an opaque base64-of-protobuf blob that does
+	// not preserve numeric ID or string Name order.
+	sort.Slice(matches, func(i, j int) bool {
+		return compareKeys(matches[i].key, matches[j].key) < 0
+	})
+	if info.orderField != "" {
+		sort.SliceStable(matches, func(i, j int) bool {
+			pi := c.props[matches[i].key.Kind][matches[i].key.Encode()]
+			pj := c.props[matches[j].key.Kind][matches[j].key.Encode()]
+			si, sj := fmt.Sprint(pi[info.orderField]), fmt.Sprint(pj[info.orderField])
+			if info.orderDesc {
+				return sj < si
+			}
+			return si < sj
+		})
+	}
+
+	if info.startOffset > 0 {
+		if info.startOffset >= len(matches) {
+			matches = nil
+		} else {
+			matches = matches[info.startOffset:]
+		}
+	}
+	base = info.startOffset
+
+	if info.limit > 0 && info.limit < len(matches) {
+		matches = matches[:info.limit]
+	}
+	return matches, base, nil
+}
+
+func keyHasAncestor(k, ancestor *datastore.Key) bool {
+	for p := k.Parent; p != nil; p = p.Parent {
+		if p.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+type parsedQuery struct {
+	kind        string
+	ancestor    *datastore.Key
+	limit       int
+	filterField string
+	filterValue interface{}
+	orderField  string
+	orderDesc   bool
+	startOffset int
+}
+
+// parseQuery pulls the handful of unexported datastore.Query fields
+// FakeClient needs out via reflection, since the Datastore client package
+// exposes no accessors for them. This is inherently coupled to the layout
+// of cloud.google.com/go/datastore's Query struct.
+func parseQuery(q *datastore.Query) (parsedQuery, error) {
+	var pq parsedQuery
+	qv := reflect.ValueOf(q).Elem()
+
+	if kind := unexportedField(qv, "kind"); kind.IsValid() {
+		pq.kind = kind.String()
+	}
+	if anc := unexportedField(qv, "ancestor"); anc.IsValid() && !anc.IsNil() {
+		pq.ancestor, _ = anc.Interface().(*datastore.Key)
+	}
+	if limit := unexportedField(qv, "limit"); limit.IsValid() {
+		pq.limit = int(limit.Int())
+	}
+	if filters := unexportedField(qv, "filter"); filters.IsValid() && filters.Len() > 0 {
+		// filters holds []datastore.EntityFilter, an interface slice, so
+		// Index(0) is an Interface-kind Value - unwrap it before looking at
+		// the concrete filter type underneath.
+		switch f := filters.Index(0).Interface().(type) {
+		case datastore.PropertyFilter:
+			pq.filterField = f.FieldName
+			pq.filterValue = f.Value
+		default:
+			return pq, fmt.Errorf("gostotest: unsupported filter type %T; FakeClient only supports a single equality PropertyFilter", f)
+		}
+	}
+	if orders := unexportedField(qv, "order"); orders.IsValid() && orders.Len() > 0 {
+		o := orders.Index(0)
+		pq.orderField = o.FieldByName("FieldName").String()
+		// Direction's underlying type is bool (datastore: ascending = false),
+		// not an integer, so read it with Bool rather than Int.
+		pq.orderDesc = o.FieldByName("Direction").Bool()
+	}
+	if start := unexportedField(qv, "start"); start.IsValid() && start.Len() > 0 {
+		b, _ := start.Interface().([]byte)
+		off, err := decodeFakeCursor(b)
+		if err != nil {
+			return pq, err
+		}
+		pq.startOffset = off
+	}
+	return pq, nil
+}
+
+// unexportedField returns an addressable, readable copy of v's field named
+// name, bypassing the reflect restriction on unexported fields.
+func unexportedField(v reflect.Value, name string) reflect.Value {
+	f := v.FieldByName(name)
+	if !f.IsValid() {
+		return reflect.Value{}
+	}
+	return reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem()
+}
@@ -0,0 +1,106 @@
+package gostotest
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+type queryTestEntity struct {
+	ID       int64 `datastore:"-"`
+	Name     string
+	Priority int
+}
+
+func mustPut(t *testing.T, ctx context.Context, c *FakeClient, id int64, name string, priority int) *datastore.Key {
+	t.Helper()
+	k := datastore.IDKey("queryTestEntity", id, nil)
+	if _, err := c.Put(ctx, k, &queryTestEntity{Name: name, Priority: priority}); err != nil {
+		t.Fatalf("Put(%d): %v", id, err)
+	}
+	return k
+}
+
+// TestFakeClientFilterAndOrder exercises a FakeClient query combining an
+// equality filter with a descending order, guarding the parseQuery
+// reflection that unwraps datastore.Query's unexported filter/order
+// fields (filter is a []EntityFilter of PropertyFilter, order's Direction
+// is a bool, not an int).
+func TestFakeClientFilterAndOrder(t *testing.T) {
+	ctx := context.Background()
+	c := NewFakeClient()
+
+	mustPut(t, ctx, c, 1, "alice", 2)
+	mustPut(t, ctx, c, 2, "bob", 2)
+	mustPut(t, ctx, c, 3, "carol", 1)
+
+	q := datastore.NewQuery("queryTestEntity").
+		FilterField("Priority", "=", 2).
+		Order("-Name")
+
+	var got []queryTestEntity
+	keys, err := c.GetAll(ctx, q, &got)
+	if err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("len(keys) = %d, want 2", len(keys))
+	}
+	if got[0].Name != "bob" || got[1].Name != "alice" {
+		t.Fatalf("got = %+v, want [bob alice] (descending by Name among Priority=2)", got)
+	}
+}
+
+// TestFakeClientRunCursor exercises Run's cursor support, confirming a
+// cursor obtained mid-iteration resumes at the correct absolute offset
+// when handed to a fresh query via Start.
+func TestFakeClientRunCursor(t *testing.T) {
+	ctx := context.Background()
+	c := NewFakeClient()
+
+	for i := int64(1); i <= 5; i++ {
+		mustPut(t, ctx, c, i, "e", 0)
+	}
+
+	q := datastore.NewQuery("queryTestEntity").Limit(2)
+	it := c.Run(ctx, q)
+
+	var names []string
+	var ids []int64
+	var cursor datastore.Cursor
+	for i := 0; i < 2; i++ {
+		var e queryTestEntity
+		k, err := it.Next(&e)
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		names = append(names, e.Name)
+		ids = append(ids, k.ID)
+		var err error
+		cursor, err = it.Cursor()
+		if err != nil {
+			t.Fatalf("Cursor: %v", err)
+		}
+	}
+
+	resumed := c.Run(ctx, datastore.NewQuery("queryTestEntity").Start(cursor).Limit(2))
+	for i := 0; i < 2; i++ {
+		var e queryTestEntity
+		k, err := resumed.Next(&e)
+		if err != nil {
+			t.Fatalf("resumed Next: %v", err)
+		}
+		names = append(names, e.Name)
+		ids = append(ids, k.ID)
+	}
+
+	if len(names) != 4 {
+		t.Fatalf("got %d names, want 4 (no overlap/gap across the cursor resume)", len(names))
+	}
+	for i, id := range ids {
+		if want := int64(i + 1); id != want {
+			t.Fatalf("ids = %v, want [1 2 3 4] (no overlap/gap across the cursor resume)", ids)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package gosto
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"cloud.google.com/go/datastore"
+	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
+)
+
+// gostoOptions accumulates the settings applied by Option functions before
+// NewGostoWithOptions builds the client.
+type gostoOptions struct {
+	client              dsiface.Client
+	databaseID          string
+	ignoreFieldMismatch *bool
+	eventualConsistency bool
+	kindNameResolver    KindNameResolver
+}
+
+// Option configures a Gosto built by NewGostoWithOptions.
+type Option func(*gostoOptions)
+
+// WithIgnoreFieldMismatch overrides the package-level IgnoreFieldMismatch
+// default for this client only, avoiding the race and cross-client
+// coupling of setting the global.
+func WithIgnoreFieldMismatch(ignore bool) Option {
+	return func(o *gostoOptions) { o.ignoreFieldMismatch = &ignore }
+}
+
+// WithDatabaseID targets a non-default Firestore-in-Datastore database,
+// routing client construction through datastore.NewClientWithDatabase
+// instead of datastore.NewClient.
+func WithDatabaseID(databaseID string) Option {
+	return func(o *gostoOptions) { o.databaseID = databaseID }
+}
+
+// WithEventualConsistency makes queries run through Count, GetAll, and Run
+// use eventual, rather than strong, consistency.
+func WithEventualConsistency(eventual bool) Option {
+	return func(o *gostoOptions) { o.eventualConsistency = eventual }
+}
+
+// WithKindNameResolver sets the KindNameResolver used to derive an
+// entity's Kind. Defaults to DefaultKindName.
+func WithKindNameResolver(resolver KindNameResolver) Option {
+	return func(o *gostoOptions) { o.kindNameResolver = resolver }
+}
+
+// WithClient injects a dsiface.Client directly, bypassing
+// datastore.NewClient/NewClientWithDatabase entirely. This is the
+// extension point gostotest.FakeClient is meant to be plugged in through.
+func WithClient(client dsiface.Client) Option {
+	return func(o *gostoOptions) { o.client = client }
+}
+
+// NewGostoWithOptions creates a new Gosto object from the given request,
+// configured by opts. It replaces the package-level IgnoreFieldMismatch
+// global and ad-hoc client wiring with explicit, per-client settings.
+func NewGostoWithOptions(ctx context.Context, projectID string, opts ...Option) (*Gosto, error) {
+	var o gostoOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	client := o.client
+	if client == nil {
+		var dsClient *datastore.Client
+		var err error
+		if o.databaseID != "" {
+			dsClient, err = datastore.NewClientWithDatabase(ctx, projectID, o.databaseID)
+		} else {
+			dsClient, err = datastore.NewClient(ctx, projectID)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Gosto: failed to initialize a datastore client.")
+		}
+		client = dsiface.AdaptClient(dsClient)
+	}
+
+	resolver := o.kindNameResolver
+	if resolver == nil {
+		resolver = DefaultKindName
+	}
+
+	return &Gosto{
+		Context:             ctx,
+		DSClient:            client,
+		KindNameResolver:    resolver,
+		ignoreFieldMismatch: o.ignoreFieldMismatch,
+		eventualConsistency: o.eventualConsistency,
+		local:               make(map[string][]byte),
+	}, nil
+}
@@ -1,27 +1,54 @@
 package gosto
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 
 	"cloud.google.com/go/datastore"
+	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
 )
 
-// Count returns the number of results for the query.
+// withEventualConsistency applies g's configured consistency to q, if
+// WithEventualConsistency was used to request it.
+func (g *Gosto) withEventualConsistency(q *datastore.Query) *datastore.Query {
+	if g.eventualConsistency {
+		return q.EventualConsistency()
+	}
+	return q
+}
+
+// Count is the same as CountCtx, using g.Context.
+//
+// Deprecated: prefer CountCtx so caller cancellation and deadlines reach
+// the underlying Datastore RPC.
 func (g *Gosto) Count(q *datastore.Query) (int, error) {
-	return g.DSClient.Count(g.Context, q)
+	return g.CountCtx(g.Context, q)
+}
+
+// CountCtx returns the number of results for the query.
+func (g *Gosto) CountCtx(ctx context.Context, q *datastore.Query) (int, error) {
+	return g.DSClient.Count(ctx, g.withEventualConsistency(q))
+}
+
+// GetAll is the same as GetAllCtx, using g.Context.
+//
+// Deprecated: prefer GetAllCtx so caller cancellation and deadlines reach
+// the underlying Datastore RPC.
+func (g *Gosto) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	return g.GetAllCtx(g.Context, q, dst)
 }
 
-// GetAll runs the query and returns all the keys that match the query, as well
-// as appending the values to dst, setting the Gosto key fields of dst, and
-// caching the returned data in local memory.
+// GetAllCtx runs the query and returns all the keys that match the query, as
+// well as appending the values to dst and setting the Gosto key fields of
+// dst. Query results are not written to either cache tier.
 //
-// For "keys-only" queries dst can be nil, however if it is not, then GetAll
-// appends zero value structs to dst, only setting the Gosto key fields.
-// No data is cached with "keys-only" queries.
+// For "keys-only" queries dst can be nil, however if it is not, then
+// GetAllCtx appends zero value structs to dst, only setting the Gosto key
+// fields.
 //
 // See: https://developers.google.com/appengine/docs/go/datastore/reference#Query.GetAll
-func (g *Gosto) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+func (g *Gosto) GetAllCtx(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
 	v := reflect.ValueOf(dst)
 	vLenBefore := 0
 
@@ -38,12 +65,10 @@ func (g *Gosto) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, e
 		vLenBefore = v.Len()
 	}
 
-	keys, err := g.DSClient.GetAll(g.Context, q, dst)
+	keys, err := g.DSClient.GetAll(ctx, g.withEventualConsistency(q), dst)
 	if err != nil {
 		if errFieldMismatch(err) {
-			if IgnoreFieldMismatch {
-				err = nil
-			}
+			err = g.processFieldMismatchError(err)
 		} else {
 			return keys, err
 		}
@@ -89,17 +114,25 @@ func (g *Gosto) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, e
 	return keys, err
 }
 
-// Run runs the query.
+// Run is the same as RunCtx, using g.Context.
+//
+// Deprecated: prefer RunCtx so caller cancellation and deadlines reach the
+// underlying Datastore RPCs issued while paging through results.
 func (g *Gosto) Run(q *datastore.Query) *Iterator {
+	return g.RunCtx(g.Context, q)
+}
+
+// RunCtx runs the query.
+func (g *Gosto) RunCtx(ctx context.Context, q *datastore.Query) *Iterator {
 	return &Iterator{
 		g: g,
-		i: g.DSClient.Run(g.Context, q),
+		i: g.DSClient.Run(ctx, g.withEventualConsistency(q)),
 	}
 }
 
 type Iterator struct {
 	g *Gosto
-	i *datastore.Iterator
+	i dsiface.Iterator
 }
 
 func (t *Iterator) Cursor() (datastore.Cursor, error) {
@@ -108,7 +141,7 @@ func (t *Iterator) Cursor() (datastore.Cursor, error) {
 
 func (t *Iterator) Next(dst interface{}) (*datastore.Key, error) {
 	k, err := t.i.Next(dst)
-	if err != nil && (!IgnoreFieldMismatch || !errFieldMismatch(err)) {
+	if err != nil && (!t.g.ignoreMismatch() || !errFieldMismatch(err)) {
 		return k, err
 	}
 
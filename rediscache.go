@@ -0,0 +1,71 @@
+package gosto
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// RedisCache is a reference Cache implementation backed by Redis, suitable
+// for sharing the two-tier cache across multiple instances the way App
+// Engine's memcache does for goon.
+type RedisCache struct {
+	Client *redis.Client
+}
+
+// NewRedisCache wraps an existing Redis client as a Cache.
+func NewRedisCache(client *redis.Client) *RedisCache {
+	return &RedisCache{Client: client}
+}
+
+// GetMulti returns the cached payloads for the given keys. Keys Redis has
+// no value for are simply omitted from the result rather than erroring.
+func (r *RedisCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	vals, err := r.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "RedisCache: failed to get keys")
+	}
+	items := make(map[string][]byte, len(keys))
+	for i, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		items[keys[i]] = []byte(s)
+	}
+	return items, nil
+}
+
+// SetMulti stores items in Redis without an expiry, using timeout as the
+// deadline for the write itself.
+func (r *RedisCache) SetMulti(ctx context.Context, items map[string][]byte, timeout time.Duration) error {
+	if len(items) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	pipe := r.Client.Pipeline()
+	for k, v := range items {
+		pipe.Set(ctx, k, v, 0)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return errors.Wrap(err, "RedisCache: failed to set keys")
+	}
+	return nil
+}
+
+// DeleteMulti removes keys from Redis.
+func (r *RedisCache) DeleteMulti(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := r.Client.Del(ctx, keys...).Err(); err != nil {
+		return errors.Wrap(err, "RedisCache: failed to delete keys")
+	}
+	return nil
+}
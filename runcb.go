@@ -0,0 +1,342 @@
+package gosto
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// CursorCB lets a RunCB or RunMulti callback fetch the cursor positioned
+// just after the item it was called with, typically to resume iteration
+// from a saved point later.
+type CursorCB func() (datastore.Cursor, error)
+
+// Stop is returned by a RunCB or RunMulti callback to halt iteration
+// cleanly. Any other non-nil error aborts iteration and is returned from
+// RunCB/RunMulti as-is.
+var Stop = fmt.Errorf("gosto: stop iteration")
+
+// cursorPageSize bounds how many results RunCB pages through before
+// re-issuing the query with q.Start(cursor), so a long-running scan
+// survives individual gRPC deadlines.
+const cursorPageSize = 500
+
+var (
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	keyType      = reflect.TypeOf((*datastore.Key)(nil))
+	cursorCBType = reflect.TypeOf(CursorCB(nil))
+)
+
+// cbDescriptor records what a RunCB/RunMulti callback expects, derived
+// once via reflection so RunCB doesn't re-inspect cb's type per result.
+type cbDescriptor struct {
+	elemType   reflect.Type // the T in func(*T, ...); unset when keyOnly
+	keyOnly    bool         // cb is func(*datastore.Key, ...) error
+	wantCursor bool         // cb's last argument is a CursorCB
+}
+
+// newCBDescriptor validates cb against the signatures RunCB/RunMulti
+// support:
+//
+//	func(*T) error
+//	func(*T, CursorCB) error
+//	func(*datastore.Key, CursorCB) error
+func newCBDescriptor(cb interface{}) (*cbDescriptor, error) {
+	cbType := reflect.TypeOf(cb)
+	if cbType == nil || cbType.Kind() != reflect.Func {
+		return nil, fmt.Errorf("gosto: RunCB callback must be a function, got %T", cb)
+	}
+	if cbType.NumIn() < 1 || cbType.NumIn() > 2 {
+		return nil, fmt.Errorf("gosto: RunCB callback has an unsupported signature: %v", cbType)
+	}
+	if cbType.NumOut() != 1 || !cbType.Out(0).Implements(errorType) {
+		return nil, fmt.Errorf("gosto: RunCB callback must return a single error, got %v", cbType)
+	}
+
+	desc := &cbDescriptor{}
+	switch in0 := cbType.In(0); {
+	case in0 == keyType:
+		desc.keyOnly = true
+	case in0.Kind() == reflect.Ptr && in0.Elem().Kind() == reflect.Struct:
+		desc.elemType = in0.Elem()
+	default:
+		return nil, fmt.Errorf("gosto: RunCB callback's first argument must be *datastore.Key or a struct pointer, got %v", in0)
+	}
+
+	if cbType.NumIn() == 2 {
+		if cbType.In(1) != cursorCBType {
+			return nil, fmt.Errorf("gosto: RunCB callback's second argument must be gosto.CursorCB, got %v", cbType.In(1))
+		}
+		desc.wantCursor = true
+	}
+	return desc, nil
+}
+
+// newDst allocates a destination matching desc (or nil for a key-only
+// descriptor) for it.Next to fill in.
+func (desc *cbDescriptor) newDst() (dst interface{}, ev reflect.Value) {
+	if desc.keyOnly {
+		return nil, reflect.Value{}
+	}
+	ev = reflect.New(desc.elemType)
+	return ev.Interface(), ev
+}
+
+// call invokes cb with the decoded result (or key, for a key-only
+// descriptor) and, if desc.wantCursor, cursor.
+func (desc *cbDescriptor) call(cbVal reflect.Value, key *datastore.Key, ev reflect.Value, cursor CursorCB) error {
+	args := make([]reflect.Value, 0, 2)
+	if desc.keyOnly {
+		args = append(args, reflect.ValueOf(key))
+	} else {
+		args = append(args, ev)
+	}
+	if desc.wantCursor {
+		args = append(args, reflect.ValueOf(cursor))
+	}
+	err, _ := cbVal.Call(args)[0].Interface().(error)
+	return err
+}
+
+// RunCB is the same as RunCBCtx, using g.Context.
+//
+// Deprecated: prefer RunCBCtx so caller cancellation and deadlines reach
+// the underlying Datastore RPCs issued while paging through results.
+func (g *Gosto) RunCB(q *datastore.Query, cb interface{}) error {
+	return g.RunCBCtx(g.Context, q, cb)
+}
+
+// RunCBCtx runs q, invoking cb once per result in order. cb must be one
+// of:
+//
+//	func(*T) error
+//	func(*T, CursorCB) error
+//	func(*datastore.Key, CursorCB) error
+//
+// for some struct type T; the key field of each decoded T is set via
+// setStructKey before cb is called. Returning Stop from cb halts
+// iteration cleanly; any other non-nil error aborts it and is returned by
+// RunCBCtx. RunCBCtx pages through q in cursorPageSize-sized chunks,
+// re-issuing the query with q.Start(cursor) between pages, so a
+// long-running scan survives individual gRPC deadlines.
+func (g *Gosto) RunCBCtx(ctx context.Context, q *datastore.Query, cb interface{}) error {
+	desc, err := newCBDescriptor(cb)
+	if err != nil {
+		return err
+	}
+	cbVal := reflect.ValueOf(cb)
+
+	page := q.Limit(cursorPageSize)
+	for {
+		it := g.RunCtx(ctx, page)
+		count := 0
+		pageFull := false
+
+		for {
+			dst, ev := desc.newDst()
+			key, nerr := it.Next(dst)
+			if nerr == iterator.Done {
+				break
+			}
+			if nerr != nil {
+				return nerr
+			}
+			count++
+
+			if !desc.keyOnly {
+				if serr := g.setStructKey(dst, key); serr != nil {
+					return serr
+				}
+			}
+
+			if cerr := desc.call(cbVal, key, ev, it.Cursor); cerr != nil {
+				if cerr == Stop {
+					return nil
+				}
+				return cerr
+			}
+
+			if count >= cursorPageSize {
+				pageFull = true
+				break
+			}
+		}
+
+		if !pageFull {
+			return nil
+		}
+		cursor, cerr := it.Cursor()
+		if cerr != nil {
+			return cerr
+		}
+		page = q.Start(cursor).Limit(cursorPageSize)
+	}
+}
+
+// runMultiItem is one query's current head result, tracked in
+// runMultiHeap so RunMulti can merge several queries in key order.
+type runMultiItem struct {
+	key *datastore.Key
+	dst interface{}
+	ev  reflect.Value
+	it  *Iterator
+	idx int // originating query index, breaking ties deterministically
+}
+
+// runMultiHeap is a container/heap.Interface ordering runMultiItems by
+// their key's natural Datastore order, so RunMulti can pop results across
+// several queries in a single sorted stream.
+type runMultiHeap []*runMultiItem
+
+func (h runMultiHeap) Len() int { return len(h) }
+func (h runMultiHeap) Less(i, j int) bool {
+	if c := compareKeys(h[i].key, h[j].key); c != 0 {
+		return c < 0
+	}
+	return h[i].idx < h[j].idx
+}
+
+// compareKeys orders a and b the way Datastore orders keys: by ancestor
+// path from root to leaf, comparing each path element by Kind and then by
+// ID (numerically) or Name (lexically). Key.Encode() must NOT be used for
+// this - it's an opaque base64-of-protobuf blob with no relation to
+// numeric ID or string Name order.
+func compareKeys(a, b *datastore.Key) int {
+	ap, bp := keyPath(a), keyPath(b)
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		if c := compareKeyElem(ap[i], bp[i]); c != 0 {
+			return c
+		}
+	}
+	return len(ap) - len(bp)
+}
+
+// keyPath returns k's ancestor chain from root to k itself.
+func keyPath(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
+
+// compareKeyElem orders two keys at the same ancestor depth by Kind, then
+// by ID/Name: a numeric ID sorts before any string Name, and within the
+// same kind of identifier, IDs compare numerically and Names lexically.
+func compareKeyElem(a, b *datastore.Key) int {
+	if a.Kind != b.Kind {
+		if a.Kind < b.Kind {
+			return -1
+		}
+		return 1
+	}
+	aID, bID := a.Name == "", b.Name == ""
+	if aID != bID {
+		if aID {
+			return -1
+		}
+		return 1
+	}
+	if aID {
+		switch {
+		case a.ID < b.ID:
+			return -1
+		case a.ID > b.ID:
+			return 1
+		default:
+			return 0
+		}
+	}
+	switch {
+	case a.Name < b.Name:
+		return -1
+	case a.Name > b.Name:
+		return 1
+	default:
+		return 0
+	}
+}
+func (h runMultiHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *runMultiHeap) Push(x interface{}) { *h = append(*h, x.(*runMultiItem)) }
+func (h *runMultiHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// RunMulti is the same as RunMultiCtx, using g.Context.
+//
+// Deprecated: prefer RunMultiCtx so caller cancellation and deadlines
+// reach the underlying Datastore RPCs.
+func (g *Gosto) RunMulti(queries []*datastore.Query, cb interface{}) error {
+	return g.RunMultiCtx(g.Context, queries, cb)
+}
+
+// RunMultiCtx runs queries and merges their results into a single stream
+// ordered by key, so disjunctive filters that would otherwise need
+// separate OR'd queries can be fanned out and consumed as one sorted
+// sequence. cb follows the same signature rules as RunCBCtx.
+func (g *Gosto) RunMultiCtx(ctx context.Context, queries []*datastore.Query, cb interface{}) error {
+	desc, err := newCBDescriptor(cb)
+	if err != nil {
+		return err
+	}
+	cbVal := reflect.ValueOf(cb)
+
+	h := make(runMultiHeap, 0, len(queries))
+	for idx, q := range queries {
+		item, ok, nerr := g.nextRunMultiItem(g.RunCtx(ctx, q), desc, idx)
+		if nerr != nil {
+			return nerr
+		}
+		if ok {
+			h = append(h, item)
+		}
+	}
+	heap.Init(&h)
+
+	for h.Len() > 0 {
+		item := heap.Pop(&h).(*runMultiItem)
+
+		if cerr := desc.call(cbVal, item.key, item.ev, item.it.Cursor); cerr != nil {
+			if cerr == Stop {
+				return nil
+			}
+			return cerr
+		}
+
+		next, ok, nerr := g.nextRunMultiItem(item.it, desc, item.idx)
+		if nerr != nil {
+			return nerr
+		}
+		if ok {
+			heap.Push(&h, next)
+		}
+	}
+	return nil
+}
+
+// nextRunMultiItem decodes the next result from it, setting its key field
+// via setStructKey. ok is false, with a nil error, once it is exhausted.
+func (g *Gosto) nextRunMultiItem(it *Iterator, desc *cbDescriptor, idx int) (item *runMultiItem, ok bool, err error) {
+	dst, ev := desc.newDst()
+	key, err := it.Next(dst)
+	if err == iterator.Done {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if !desc.keyOnly {
+		if serr := g.setStructKey(dst, key); serr != nil {
+			return nil, false, serr
+		}
+	}
+	return &runMultiItem{key: key, dst: dst, ev: ev, it: it, idx: idx}, true, nil
+}
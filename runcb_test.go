@@ -0,0 +1,160 @@
+package gosto
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/timakin/gosto/gostotest"
+)
+
+type runCBTestEntity struct {
+	ID    int64 `datastore:"-" goon:"id"`
+	Name  string
+	Group string
+}
+
+// TestRunCBPagesAcrossCursorPageSize exercises RunCBCtx with more results
+// than cursorPageSize, guarding the q.Start(cursor)/Limit(cursorPageSize)
+// re-issue loop that lets a long scan survive individual page boundaries.
+func TestRunCBPagesAcrossCursorPageSize(t *testing.T) {
+	ctx := context.Background()
+	g, err := NewGostoWithOptions(ctx, "test-project", WithClient(gostotest.NewFakeClient()))
+	if err != nil {
+		t.Fatalf("NewGostoWithOptions: %v", err)
+	}
+
+	const n = cursorPageSize + 7
+	puts := make([]*runCBTestEntity, n)
+	for i := 0; i < n; i++ {
+		puts[i] = &runCBTestEntity{ID: int64(i + 1), Name: fmt.Sprintf("entity-%d", i)}
+	}
+	if _, err := g.PutMultiCtx(ctx, puts); err != nil {
+		t.Fatalf("PutMultiCtx: %v", err)
+	}
+
+	var seen []string
+	err = g.RunCBCtx(ctx, datastore.NewQuery("runCBTestEntity"), func(e *runCBTestEntity) error {
+		seen = append(seen, e.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RunCBCtx: %v", err)
+	}
+	if len(seen) != n {
+		t.Fatalf("RunCBCtx visited %d entities, want %d", len(seen), n)
+	}
+}
+
+// TestRunCBStop confirms that returning Stop from the callback halts
+// iteration cleanly, without RunCBCtx propagating it as a real error.
+func TestRunCBStop(t *testing.T) {
+	ctx := context.Background()
+	g, err := NewGostoWithOptions(ctx, "test-project", WithClient(gostotest.NewFakeClient()))
+	if err != nil {
+		t.Fatalf("NewGostoWithOptions: %v", err)
+	}
+
+	puts := []*runCBTestEntity{
+		{ID: 1, Name: "a"}, {ID: 2, Name: "b"}, {ID: 3, Name: "c"},
+	}
+	if _, err := g.PutMultiCtx(ctx, puts); err != nil {
+		t.Fatalf("PutMultiCtx: %v", err)
+	}
+
+	count := 0
+	err = g.RunCBCtx(ctx, datastore.NewQuery("runCBTestEntity"), func(e *runCBTestEntity) error {
+		count++
+		return Stop
+	})
+	if err != nil {
+		t.Fatalf("RunCBCtx: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("callback ran %d times after Stop, want 1", count)
+	}
+}
+
+// TestRunMultiMergesInKeyOrder exercises RunMultiCtx with two disjoint
+// queries, confirming it merges their results into a single stream
+// ordered by key rather than concatenating per-query results.
+func TestRunMultiMergesInKeyOrder(t *testing.T) {
+	ctx := context.Background()
+	g, err := NewGostoWithOptions(ctx, "test-project", WithClient(gostotest.NewFakeClient()))
+	if err != nil {
+		t.Fatalf("NewGostoWithOptions: %v", err)
+	}
+
+	puts := []*runCBTestEntity{
+		{ID: 1, Name: "one", Group: "odd"}, {ID: 2, Name: "two", Group: "even"},
+		{ID: 3, Name: "three", Group: "odd"}, {ID: 4, Name: "four", Group: "even"},
+	}
+	if _, err := g.PutMultiCtx(ctx, puts); err != nil {
+		t.Fatalf("PutMultiCtx: %v", err)
+	}
+
+	odds := datastore.NewQuery("runCBTestEntity").FilterField("Group", "=", "odd")
+	evens := datastore.NewQuery("runCBTestEntity").FilterField("Group", "=", "even")
+
+	var ids []int64
+	err = g.RunMultiCtx(ctx, []*datastore.Query{odds, evens}, func(e *runCBTestEntity) error {
+		ids = append(ids, e.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RunMultiCtx: %v", err)
+	}
+
+	if len(ids) != len(puts) {
+		t.Fatalf("ids = %v, want %d entities merged", ids, len(puts))
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] < ids[i-1] {
+			t.Fatalf("ids = %v, not in non-decreasing key order", ids)
+		}
+	}
+}
+
+// TestRunMultiMergesInNumericKeyOrderNotEncodeOrder uses IDs whose
+// Key.Encode() string order disagrees with their numeric order (ID 127
+// encodes to a lexically smaller string than ID 100, and ID 256 to a
+// smaller one than ID 200), guarding against the merge comparator ever
+// regressing to Key.Encode() string comparison.
+func TestRunMultiMergesInNumericKeyOrderNotEncodeOrder(t *testing.T) {
+	ctx := context.Background()
+	g, err := NewGostoWithOptions(ctx, "test-project", WithClient(gostotest.NewFakeClient()))
+	if err != nil {
+		t.Fatalf("NewGostoWithOptions: %v", err)
+	}
+
+	puts := []*runCBTestEntity{
+		{ID: 100, Name: "a100", Group: "a"}, {ID: 200, Name: "a200", Group: "a"},
+		{ID: 127, Name: "b127", Group: "b"}, {ID: 256, Name: "b256", Group: "b"},
+	}
+	if _, err := g.PutMultiCtx(ctx, puts); err != nil {
+		t.Fatalf("PutMultiCtx: %v", err)
+	}
+
+	groupA := datastore.NewQuery("runCBTestEntity").FilterField("Group", "=", "a")
+	groupB := datastore.NewQuery("runCBTestEntity").FilterField("Group", "=", "b")
+
+	var ids []int64
+	err = g.RunMultiCtx(ctx, []*datastore.Query{groupA, groupB}, func(e *runCBTestEntity) error {
+		ids = append(ids, e.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RunMultiCtx: %v", err)
+	}
+
+	want := []int64{100, 127, 200, 256}
+	if len(ids) != len(want) {
+		t.Fatalf("ids = %v, want %v", ids, want)
+	}
+	for i, id := range ids {
+		if id != want[i] {
+			t.Fatalf("ids = %v, want %v (numeric key order, not Key.Encode() order)", ids, want)
+		}
+	}
+}